@@ -0,0 +1,695 @@
+// Copyright 2023 Firefly IT Consulting Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package controller implements the watch-based reconciler that replaces terminator's
+// original list-everything-on-a-timer scan. A Pod informer enqueues keys for pods that
+// have a DeletionTimestamp set, and a pool of workers drains the queue, re-enqueueing
+// with a delay when a pod's synthetic grace period has not yet elapsed.
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fireflycons/terminator/pkg/metrics"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Taint applied to nodes that have been detected as shut down non-gracefully, signalling
+// to the attach/detach controller that volumes on the node can be force-detached.
+const outOfServiceTaintValue = "nodeshutdown"
+
+// Deletion modes accepted by Config.Mode.
+const (
+	ModeForceDelete = "force-delete"
+	ModeEvict       = "evict"
+)
+
+// Config carries the subset of CLI options the controller needs to reconcile pods.
+// It is built once in main and handed to New.
+type Config struct {
+	DryRun                  bool
+	GracePeriod             time.Duration
+	Namespaces              []string
+	Pods                    []string
+	NoRemoveFinalizers      bool
+	EnableOutOfServiceTaint bool
+	OutOfServiceTaintKey    string
+	NodeOutOfServiceTimeout time.Duration
+
+	// Mode selects between force-delete (the original behaviour) and evict, which attempts a
+	// PDB-respecting eviction before falling back to force-delete.
+	Mode                 string
+	EvictionRetryBackoff time.Duration
+	EvictionMaxRetries   int
+	AllowForceFallback   bool
+}
+
+// Controller reconciles Terminating pods using informer caches rather than periodic lists.
+type Controller struct {
+	cfg       Config
+	clientset *kubernetes.Clientset
+	logger    log.Logger
+
+	podLister   listersv1.PodLister
+	podsSynced  cache.InformerSynced
+	nodeLister  listersv1.NodeLister
+	nodesSynced cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+
+	evictionRetriesMu sync.Mutex
+	evictionRetries   map[string]int
+
+	// taintedNodes tracks nodes this process has applied the out-of-service taint to, so that
+	// Run can attempt to clean them all up on shutdown even if their last Terminating pod never
+	// triggered cleanupOutOfServiceTaint (e.g. the process is killed before that happens).
+	taintedNodesMu sync.Mutex
+	taintedNodes   map[string]struct{}
+
+	// OnSynced, if set, is called once the informer caches have completed their initial sync.
+	// main uses this to flip the /readyz endpoint.
+	OnSynced func()
+}
+
+// New builds a Controller wired to a Pod informer from podFactory and a Node informer from
+// nodeFactory. They are kept as separate factories because the pod watch carries server-side
+// label/field selectors (via podFactory's TweakListOptions) that do not make sense for nodes.
+func New(cfg Config, clientset *kubernetes.Clientset, podFactory, nodeFactory informers.SharedInformerFactory, logger log.Logger) *Controller {
+
+	podInformer := podFactory.Core().V1().Pods()
+	nodeInformer := nodeFactory.Core().V1().Nodes()
+
+	c := &Controller{
+		cfg:             cfg,
+		clientset:       clientset,
+		logger:          logger,
+		podLister:       podInformer.Lister(),
+		podsSynced:      podInformer.Informer().HasSynced,
+		nodeLister:      nodeInformer.Lister(),
+		nodesSynced:     nodeInformer.Informer().HasSynced,
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		evictionRetries: make(map[string]int),
+		taintedNodes:    make(map[string]struct{}),
+	}
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueIfTerminating,
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueueIfTerminating(newObj) },
+	})
+
+	return c
+}
+
+// enqueueIfTerminating adds obj's key to the workqueue if it is a Pod with a DeletionTimestamp set.
+func (c *Controller) enqueueIfTerminating(obj interface{}) {
+
+	pod, ok := obj.(*v1.Pod)
+
+	if !ok || pod.ObjectMeta.DeletionTimestamp == nil {
+		return
+	}
+
+	if !c.matchesNamespaceFilter(pod.Namespace) || !c.matchesPodFilter(pod.Name) {
+		return
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+
+	if err != nil {
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Cannot build workqueue key for pod: %s", err.Error()))
+		return
+	}
+
+	c.queue.Add(key)
+}
+
+// matchesNamespaceFilter reports whether namespace passes the (optional) --namespaces filter.
+// It only needs to apply when the factory is watching cluster-wide, i.e. more than one
+// namespace was requested; the single-namespace case is already scoped by the informer factory.
+func (c *Controller) matchesNamespaceFilter(namespace string) bool {
+
+	if len(c.cfg.Namespaces) < 2 {
+		return true
+	}
+
+	for _, ns := range c.cfg.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesPodFilter reports whether name passes the (optional) --pods prefix filter.
+func (c *Controller) matchesPodFilter(name string) bool {
+
+	if len(c.cfg.Pods) == 0 {
+		return true
+	}
+
+	for _, prefix := range c.cfg.Pods {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run waits for the informer caches (whose factories the caller starts) to sync, then launches workers workers
+// until stopCh is closed. When stopCh closes, Run shuts down the queue and blocks until every
+// worker has drained its current item and exited, then attempts to remove any out-of-service
+// taints this process applied, before returning.
+func (c *Controller) Run(ctx context.Context, workers int, stopCh <-chan struct{}) error {
+
+	_ = level.Info(c.logger).Log("message", "Waiting for informer caches to sync")
+
+	if !cache.WaitForCacheSync(stopCh, c.podsSynced, c.nodesSynced) {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	if c.OnSynced != nil {
+		c.OnSynced()
+	}
+
+	_ = level.Info(c.logger).Log("message", fmt.Sprintf("Starting %d worker(s)", workers))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(func() { c.runWorker(ctx) }, time.Second, stopCh)
+		}()
+	}
+
+	go wait.Until(c.updateTerminatingGauge, 30*time.Second, stopCh)
+
+	<-stopCh
+
+	_ = level.Info(c.logger).Log("message", "Shutting down workers, draining queue")
+
+	c.queue.ShutDown()
+	wg.Wait()
+
+	if c.cfg.EnableOutOfServiceTaint {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c.cleanupAllTaintedNodes(cleanupCtx)
+	}
+
+	return nil
+}
+
+// updateTerminatingGauge refreshes the terminator_terminating_pods gauge from the pod cache.
+func (c *Controller) updateTerminatingGauge() {
+
+	pods, err := c.podLister.List(labels.Everything())
+
+	if err != nil {
+		return
+	}
+
+	count := 0
+
+	for _, p := range pods {
+		if p.ObjectMeta.DeletionTimestamp != nil {
+			count++
+		}
+	}
+
+	metrics.SetTerminatingPods(count)
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+
+	key, shutdown := c.queue.Get()
+
+	if shutdown {
+		return false
+	}
+
+	defer c.queue.Done(key)
+
+	requeueAfter, err := c.syncHandler(ctx, key.(string))
+
+	if err != nil {
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Error syncing '%s': %s", key, err.Error()))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+
+	if requeueAfter > 0 {
+		c.queue.AddAfter(key, requeueAfter)
+	}
+
+	return true
+}
+
+// syncHandler reconciles a single pod identified by key ("namespace/name"). If the pod's
+// synthetic grace period has not yet elapsed it returns the remaining duration so the
+// caller can re-enqueue the key for exactly when action becomes due.
+func (c *Controller) syncHandler(ctx context.Context, key string) (time.Duration, error) {
+
+	start := time.Now()
+	defer func() { metrics.ScanDuration(time.Since(start).Seconds()) }()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	metrics.PodScanned()
+
+	pod, err := c.podLister.Pods(namespace).Get(name)
+
+	if errors.IsNotFound(err) {
+		// Pod is gone, nothing left to do.
+		return 0, nil
+	}
+
+	if err != nil {
+		metrics.APIError("get")
+		return 0, err
+	}
+
+	deletionTimestamp := pod.ObjectMeta.DeletionTimestamp
+
+	if deletionTimestamp == nil {
+		// No longer terminating (shouldn't normally happen, but informer cache can be stale).
+		return 0, nil
+	}
+
+	podName := formatPodName(pod)
+
+	if isStaticPod(pod) {
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s: Cannot terminate static pod", podName))
+		return 0, nil
+	}
+
+	now := time.Now()
+	syntheticGracePeriod := (time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second) + c.cfg.GracePeriod
+	deleteBy := deletionTimestamp.Add(syntheticGracePeriod)
+
+	if now.Before(deleteBy) {
+		return deleteBy.Sub(now), nil
+	}
+
+	terminatingDuration := now.Sub(deletionTimestamp.Time).Round(time.Second)
+	_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s has been terminating for %v, which exceeds grace period of %v. Force deleting...", podName, terminatingDuration, syntheticGracePeriod))
+
+	if c.cfg.DryRun {
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s with finalizers %v would be force deleted", podName, pod.Finalizers))
+		return 0, nil
+	}
+
+	if c.cfg.Mode == ModeEvict {
+		proceedToForceDelete, requeueAfter, err := c.tryEvict(ctx, key, pod, podName)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if requeueAfter > 0 {
+			return requeueAfter, nil
+		}
+
+		if !proceedToForceDelete {
+			return 0, nil
+		}
+	}
+
+	c.handleOutOfServiceNode(ctx, pod)
+
+	podCopy := pod.DeepCopy()
+
+	if !c.removeFinalizers(ctx, podCopy) {
+		return 0, nil
+	}
+
+	c.deletePod(ctx, podCopy)
+
+	c.cleanupOutOfServiceTaint(ctx, podCopy.Spec.NodeName)
+
+	return 0, nil
+}
+
+// tryEvict attempts a PDB-respecting eviction of pod via the policy/v1 Eviction subresource.
+// It returns proceedToForceDelete=true when the caller should fall through to the existing
+// finalizer-strip + force-delete path, and a non-zero requeueAfter when the pod should be
+// retried later because a PodDisruptionBudget is currently blocking eviction.
+func (c *Controller) tryEvict(ctx context.Context, key string, pod *v1.Pod, podName string) (bool, time.Duration, error) {
+
+	gracePeriodSeconds := int64(0)
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &metav1.DeleteOptions{
+			GracePeriodSeconds: &gracePeriodSeconds,
+		},
+	}
+
+	err := c.clientset.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+
+	if err == nil {
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s evicted", podName))
+		metrics.PodForceDeleted(pod.Namespace, "evicted")
+		c.clearEvictionRetries(key)
+		return false, 0, nil
+	}
+
+	if errors.IsTooManyRequests(err) {
+		retries := c.incEvictionRetries(key)
+
+		if retries >= c.cfg.EvictionMaxRetries {
+			c.clearEvictionRetries(key)
+
+			if !c.cfg.AllowForceFallback {
+				_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s: eviction retries exhausted and --allow-force-fallback not set, giving up", podName))
+				return false, 0, nil
+			}
+
+			_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s: eviction retries exhausted, falling back to force delete", podName))
+			return true, 0, nil
+		}
+
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s: eviction blocked by PodDisruptionBudget (attempt %d/%d), retrying after %v", podName, retries, c.cfg.EvictionMaxRetries, c.cfg.EvictionRetryBackoff))
+		return false, c.cfg.EvictionRetryBackoff, nil
+	}
+
+	metrics.APIError("evict")
+	c.clearEvictionRetries(key)
+
+	return false, 0, fmt.Errorf("%s: cannot evict: %w", podName, err)
+}
+
+func (c *Controller) incEvictionRetries(key string) int {
+
+	c.evictionRetriesMu.Lock()
+	defer c.evictionRetriesMu.Unlock()
+
+	c.evictionRetries[key]++
+
+	return c.evictionRetries[key]
+}
+
+func (c *Controller) clearEvictionRetries(key string) {
+
+	c.evictionRetriesMu.Lock()
+	defer c.evictionRetriesMu.Unlock()
+
+	delete(c.evictionRetries, key)
+}
+
+// Test if a pod is static. Static pods are owned by nodes.
+func isStaticPod(pod *v1.Pod) bool {
+	for _, o := range pod.ObjectMeta.GetOwnerReferences() {
+		if o.Kind == "Node" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func formatPodName(pod *v1.Pod) string {
+	return fmt.Sprintf("Pod '%s' in namespace '%s'", pod.Name, pod.Namespace)
+}
+
+// Remove any finalizers on pod. Return false if they couldn't be removed.
+func (c *Controller) removeFinalizers(ctx context.Context, pod *v1.Pod) bool {
+
+	if len(pod.Finalizers) == 0 {
+		return true
+	}
+
+	finalizers := make([]string, len(pod.Finalizers))
+	copy(finalizers, pod.Finalizers)
+
+	if c.cfg.NoRemoveFinalizers {
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s. Cannot delete as pod has finalizers", formatPodName(pod)))
+		return false
+	}
+
+	pod.Finalizers = []string{}
+	_, err := c.clientset.CoreV1().Pods(pod.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
+
+	if err != nil {
+		metrics.APIError("update")
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s: Cannot remove finalizers: %s", formatPodName(pod), err.Error()))
+		return false
+	}
+
+	metrics.FinalizerRemoved()
+	_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s: Removed finalizers: %v ", formatPodName(pod), finalizers))
+
+	return true
+}
+
+// Delete the pod
+func (c *Controller) deletePod(ctx context.Context, pod *v1.Pod) {
+
+	gracePeriodSeconds := int64(0)
+	err := c.clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriodSeconds,
+	})
+
+	if err == nil {
+		metrics.PodForceDeleted(pod.Namespace, "success")
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s has been force deleted", formatPodName(pod)))
+		return
+	}
+
+	if se, ok := err.(*errors.StatusError); ok && se.ErrStatus.Code == 404 {
+		// Removing finalizers already deleted the pod.
+		metrics.PodForceDeleted(pod.Namespace, "success")
+		_ = level.Warn(c.logger).Log("message", fmt.Sprintf("%s has been force deleted", formatPodName(pod)))
+		return
+	}
+
+	metrics.APIError("delete")
+	metrics.PodForceDeleted(pod.Namespace, "error")
+	_ = level.Error(c.logger).Log("message", fmt.Sprintf("%s: Cannot force delete: %s", formatPodName(pod), err.Error()))
+}
+
+// Test if a node is NotReady and has been so for longer than timeout.
+func isNodeOutOfService(node *v1.Node, timeout time.Duration) bool {
+
+	now := time.Now()
+
+	for _, cond := range node.Status.Conditions {
+		if cond.Type != v1.NodeReady {
+			continue
+		}
+
+		if cond.Status == v1.ConditionTrue {
+			return false
+		}
+
+		return now.Sub(cond.LastTransitionTime.Time) > timeout
+	}
+
+	return false
+}
+
+// If the pod's node has shut down non-gracefully, apply the out-of-service taint so that
+// volumes can be safely force-detached ahead of the force-delete.
+func (c *Controller) handleOutOfServiceNode(ctx context.Context, pod *v1.Pod) {
+
+	if !c.cfg.EnableOutOfServiceTaint || pod.Spec.NodeName == "" {
+		return
+	}
+
+	node, err := c.nodeLister.Get(pod.Spec.NodeName)
+
+	if err != nil {
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot get node details: %s", pod.Spec.NodeName, err.Error()))
+		return
+	}
+
+	if !isNodeOutOfService(node, c.cfg.NodeOutOfServiceTimeout) {
+		return
+	}
+
+	c.applyOutOfServiceTaint(ctx, node)
+}
+
+// Apply the out-of-service taint to node, preserving any taints already present. v1.Taint has
+// no patchMergeKey, so a strategic-merge patch against spec.taints replaces the whole list rather
+// than appending to it; we therefore patch with the node's existing taints plus the new one.
+func (c *Controller) applyOutOfServiceTaint(ctx context.Context, node *v1.Node) {
+
+	for _, t := range node.Spec.Taints {
+		if t.Key == c.cfg.OutOfServiceTaintKey {
+			return
+		}
+	}
+
+	newTaints := append(append([]v1.Taint{}, node.Spec.Taints...), v1.Taint{
+		Key:    c.cfg.OutOfServiceTaintKey,
+		Value:  outOfServiceTaintValue,
+		Effect: v1.TaintEffectNoExecute,
+	})
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"taints": newTaints,
+		},
+	})
+
+	if err != nil {
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot build out-of-service taint patch: %s", node.Name, err.Error()))
+		return
+	}
+
+	_, err = c.clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+
+	if err != nil {
+		metrics.APIError("patch")
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot apply out-of-service taint: %s", node.Name, err.Error()))
+		return
+	}
+
+	c.taintedNodesMu.Lock()
+	c.taintedNodes[node.Name] = struct{}{}
+	c.taintedNodesMu.Unlock()
+
+	_ = level.Warn(c.logger).Log("message", fmt.Sprintf("Node '%s': Applied out-of-service taint", node.Name))
+}
+
+// Once a node has no more Terminating pods scheduled on it, remove any out-of-service
+// taint that terminator previously applied. This runs moments after applyOutOfServiceTaint
+// patched the very same node, so it deliberately reads live from the apiserver rather than
+// from the node/pod listers: the informer cache cannot yet reflect our own write, and a
+// stale cached resourceVersion would make the removal races-prone against kubelet's constant
+// node status updates. For the same reason the removal itself is a patch, not a full Update.
+func (c *Controller) cleanupOutOfServiceTaint(ctx context.Context, nodeName string) {
+
+	if !c.cfg.EnableOutOfServiceTaint || nodeName == "" {
+		return
+	}
+
+	pods, err := c.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
+	})
+
+	if err != nil {
+		metrics.APIError("list")
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot list pods to check out-of-service taint removal: %s", nodeName, err.Error()))
+		return
+	}
+
+	for _, p := range pods.Items {
+		if p.ObjectMeta.DeletionTimestamp != nil {
+			// Still Terminating pods on the node, leave the taint in place.
+			return
+		}
+	}
+
+	node, err := c.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+
+	if err != nil {
+		metrics.APIError("get")
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot get node details: %s", nodeName, err.Error()))
+		return
+	}
+
+	newTaints := make([]v1.Taint, 0, len(node.Spec.Taints))
+	found := false
+
+	for _, t := range node.Spec.Taints {
+		if t.Key == c.cfg.OutOfServiceTaintKey {
+			found = true
+			continue
+		}
+
+		newTaints = append(newTaints, t)
+	}
+
+	if !found {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"taints": newTaints,
+		},
+	})
+
+	if err != nil {
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot build out-of-service taint removal patch: %s", nodeName, err.Error()))
+		return
+	}
+
+	if _, err := c.clientset.CoreV1().Nodes().Patch(ctx, nodeName, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		metrics.APIError("patch")
+		_ = level.Error(c.logger).Log("message", fmt.Sprintf("Node '%s': Cannot remove out-of-service taint: %s", nodeName, err.Error()))
+		return
+	}
+
+	c.taintedNodesMu.Lock()
+	delete(c.taintedNodes, nodeName)
+	c.taintedNodesMu.Unlock()
+
+	_ = level.Warn(c.logger).Log("message", fmt.Sprintf("Node '%s': Removed out-of-service taint", nodeName))
+}
+
+// cleanupAllTaintedNodes attempts to remove the out-of-service taint from every node this
+// process has applied it to. It is called once, after Run's workers have drained, so that a
+// graceful shutdown doesn't abandon taints forever: without this, a node tainted just before
+// SIGTERM (or left tainted by the cleanupOutOfServiceTaint race it runs alongside) would need
+// manual `kubectl taint` cleanup. ctx is expected to carry its own deadline since stopCh has
+// already closed by the time this runs.
+func (c *Controller) cleanupAllTaintedNodes(ctx context.Context) {
+
+	c.taintedNodesMu.Lock()
+	nodeNames := make([]string, 0, len(c.taintedNodes))
+	for name := range c.taintedNodes {
+		nodeNames = append(nodeNames, name)
+	}
+	c.taintedNodesMu.Unlock()
+
+	for _, name := range nodeNames {
+		c.cleanupOutOfServiceTaint(ctx, name)
+	}
+}
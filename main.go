@@ -19,256 +19,252 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/fireflycons/terminator/controller"
+	"github.com/fireflycons/terminator/pkg/metrics"
 	"github.com/go-kit/log/level"
-	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"github.com/google/uuid"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/utils/strings/slices"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
+// Taint applied to nodes that have been detected as shut down non-gracefully, signalling
+// to the attach/detach controller that volumes on the node can be force-detached.
+const outOfServiceTaintKeyDefault = "node.kubernetes.io/out-of-service"
+
 // Struct that receives command line arguments.
 type CLI struct {
 	DryRun             bool          `short:"d" help:"If set, do not delete anything."`
 	GracePeriod        time.Duration `short:"g" help:"Additional grace period added to that of the pod in Go duration syntax, e.g 2m, 1h etc." default:"${default_grace}"`
-	Interval           time.Duration `short:"i" help:"Interval between scans of the cluster in Go duration syntax, e.g 2m, 1h etc." default:"${default_interval}"`
+	Interval           time.Duration `short:"i" help:"Resync period for the informer cache, in Go duration syntax, e.g 2m, 1h etc." default:"${default_interval}"`
 	Kubeconfig         string        `short:"k" help:"Specify a kubeconfig for authentication. If not set, then in cluster authentication is attempted."`
 	Namespaces         []string      `short:"n" help:"If set, list of namespaces to limit scans to. If not set, all namespaces are scanned."`
 	Pods               []string      `short:"p" help:"If set, list of pod name prefixes. Pods whose names begin with these prefixes will only be considered. If not set, all pods will be considered."`
 	NoRemoveFinalizers bool          `short:"r" help:"If set, do not remove any finalizers before attempting delete."`
 	StartupDelay       time.Duration `short:"s" help:"Time to wait between launching and first scan of the cluster in Go duration syntax, e.g 2m, 1h etc." default:"${default_startup}"`
+	Workers            int           `short:"w" help:"Number of worker goroutines draining the reconcile queue." default:"${default_workers}"`
+	MetricsAddr        string        `help:"Address for the /metrics, /healthz and /readyz HTTP endpoints to listen on." default:"${default_metrics_addr}"`
 	LogLevel           string        `short:"l" help:"Sets the loglevel. Valid levels are debug, info, warn, error." default:"${default_level}"`
 	LogFormat          string        `short:"f" help:"Sets the log format. Valid formats are json and logfmt." default:"${default_format}"`
 	LogOutput          string        `short:"o" help:"Sets the log output. Valid outputs are stdout and stderr." default:"${default_output}"`
+
+	EnableOutOfServiceTaint bool          `help:"If set, apply the out-of-service taint to nodes that are NotReady beyond --node-out-of-service-timeout before force-deleting pods scheduled on them."`
+	OutOfServiceTaintKey    string        `help:"Taint key to apply when --enable-out-of-service-taint is set." default:"${default_oos_taint_key}"`
+	NodeOutOfServiceTimeout time.Duration `help:"How long a node may be NotReady before it is considered shut down non-gracefully, in Go duration syntax, e.g 2m, 1h etc." default:"${default_oos_timeout}"`
+
+	EnableLeaderElection    bool   `help:"If set, use leader election so that only one of multiple replicas is ever reconciling at a time."`
+	LeaderElectionNamespace string `help:"Namespace holding the leader election Lease." default:"${default_leader_election_namespace}"`
+	LeaderElectionID        string `help:"Name of the leader election Lease." default:"${default_leader_election_id}"`
+
+	Mode                 string        `help:"Deletion mode: 'force-delete' strips finalizers and force deletes directly, 'evict' first attempts a PodDisruptionBudget-respecting eviction." enum:"force-delete,evict" default:"${default_mode}"`
+	EvictionRetryBackoff time.Duration `help:"How long to wait before retrying an eviction blocked by a PodDisruptionBudget, in Go duration syntax, e.g 2m, 1h etc." default:"${default_eviction_backoff}"`
+	EvictionMaxRetries   int           `help:"Maximum number of blocked eviction attempts before giving up (or falling back, see --allow-force-fallback)." default:"${default_eviction_max_retries}"`
+	AllowForceFallback   bool          `help:"In --mode evict, if set, fall back to the force-delete path once --eviction-max-retries is exhausted."`
+
+	LabelSelector string `help:"If set, restrict the pod watch to pods matching this label selector, evaluated server-side."`
+	FieldSelector string `help:"If set, restrict the pod watch to pods matching this field selector, evaluated server-side, in addition to the built-in phase filter."`
+	Node          string `help:"If set, restrict the pod watch to pods scheduled on this node."`
 }
 
 // goroutine that waits for any of the nomiated signals to be raised.
 // Pushes into a channel being monitored by func signalRaised() and exits when a signal is detected.
-func signalHandler(cli CLI, sigs chan os.Signal, done chan bool) {
+func signalHandler(cli CLI, sigs chan os.Signal, done chan struct{}) {
 
 	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
 	sig := <-sigs
 
 	_ = level.Info(logger).Log("message", fmt.Sprintf("INFO: Signal received: %v", sig))
-	done <- true
+	close(done)
 }
 
-// Checks to see if a signal has been raised indicating we should shut down.
-func signalRaised(raised chan bool) bool {
-	select {
-	case _, ok := <-raised:
-		if ok {
-			// Signal raised, exit.
-			return true
-		}
-	default:
-		// Do nothing
-		break
+// controllerConfig builds the controller package's Config from the parsed CLI flags.
+func controllerConfig(cli CLI) controller.Config {
+	return controller.Config{
+		DryRun:                  cli.DryRun,
+		GracePeriod:             cli.GracePeriod,
+		Namespaces:              cli.Namespaces,
+		Pods:                    cli.Pods,
+		NoRemoveFinalizers:      cli.NoRemoveFinalizers,
+		EnableOutOfServiceTaint: cli.EnableOutOfServiceTaint,
+		OutOfServiceTaintKey:    cli.OutOfServiceTaintKey,
+		NodeOutOfServiceTimeout: cli.NodeOutOfServiceTimeout,
+		Mode:                    cli.Mode,
+		EvictionRetryBackoff:    cli.EvictionRetryBackoff,
+		EvictionMaxRetries:      cli.EvictionMaxRetries,
+		AllowForceFallback:      cli.AllowForceFallback,
 	}
-
-	return false
 }
 
-// Test if a pod is static. Static pods are owned by nodes.
-func isStaticPod(pod *v1.Pod) bool {
-	for _, o := range pod.ObjectMeta.GetOwnerReferences() {
-		if o.Kind == "Node" {
-			return true
-		}
-	}
-
-	return false
-}
+// podFieldSelector combines the built-in phase filter with the optional --field-selector and
+// --node flags, so the apiserver does this filtering rather than the client.
+func podFieldSelector(cli CLI) string {
 
-func formatPodName(pod *v1.Pod) string {
-	return fmt.Sprintf("Pod '%s' in namespace '%s'", pod.Name, pod.Namespace)
-}
+	selectors := []string{"status.phase!=Succeeded", "status.phase!=Failed"}
 
-// Remove any finalizers on pod.
-// Return false if they couldn't be removed.
-func removeFinalizers(cli CLI, clientset *kubernetes.Clientset, pod *v1.Pod) bool {
-
-	if len(pod.Finalizers) == 0 {
-		return true
-	}
-
-	finalizers := make([]string, len(pod.Finalizers))
-	copy(finalizers, pod.Finalizers)
-
-	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
-
-	if cli.NoRemoveFinalizers {
-		_ = level.Warn(logger).Log("message", fmt.Sprintf("%s. Cannot delete as pod has finalizers", formatPodName(pod)))
-		return false
+	if cli.FieldSelector != "" {
+		selectors = append(selectors, cli.FieldSelector)
 	}
 
-	pod.Finalizers = []string{}
-	_, err := clientset.CoreV1().Pods(pod.Namespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
-
-	if err != nil {
-		_ = level.Warn(logger).Log("message", fmt.Sprintf("%s: Cannot remove finalizers: %s", formatPodName(pod), err.Error()))
-		return false
+	if cli.Node != "" {
+		selectors = append(selectors, fmt.Sprintf("spec.nodeName=%s", cli.Node))
 	}
 
-	_ = level.Warn(logger).Log("message", fmt.Sprintf("%s: Removed finalizers: %v ", formatPodName(pod), finalizers))
-
-	return true
+	return strings.Join(selectors, ",")
 }
 
-// Delete the pod
-func deletePod(cli CLI, clientset *kubernetes.Clientset, pod *v1.Pod) {
+// newPodInformerFactory builds the SharedInformerFactory used for the pod watch, resynced every
+// cli.Interval, scoped to a single namespace when exactly one was supplied via --namespaces, and
+// with server-side label/field selectors applied so unwanted pods never cross the wire.
+func newPodInformerFactory(cli CLI, clientset *kubernetes.Clientset) informers.SharedInformerFactory {
 
-	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
-
-	gracePeriodSeconds := int64(0)
-	err := clientset.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{
-		GracePeriodSeconds: &gracePeriodSeconds,
+	tweakListOptions := informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = cli.LabelSelector
+		opts.FieldSelector = podFieldSelector(cli)
 	})
 
-	if err == nil {
-		_ = level.Warn(logger).Log("message", fmt.Sprintf("%s has been force deleted", formatPodName(pod)))
-		return
+	if len(cli.Namespaces) == 1 {
+		return informers.NewSharedInformerFactoryWithOptions(clientset, cli.Interval, informers.WithNamespace(cli.Namespaces[0]), tweakListOptions)
 	}
 
-	if se, ok := err.(*errors.StatusError); ok && se.ErrStatus.Code == 404 {
-		// Removing finalizers already deleted the pod.
-		_ = level.Warn(logger).Log("message", fmt.Sprintf("%s has been force deleted", formatPodName(pod)))
-		return
-	}
-
-	_ = level.Error(logger).Log("message", fmt.Sprintf("%s: Cannot force delete: %s", formatPodName(pod), err.Error()))
+	// For zero or multiple namespaces we watch cluster-wide and filter in the event handler,
+	// since client-go's shared factory only supports a single namespace scope.
+	return informers.NewSharedInformerFactoryWithOptions(clientset, cli.Interval, tweakListOptions)
 }
 
-// Check whether a pod is stuck in Terminating. Force delete if it is.
-func processPod(cli CLI, clientset *kubernetes.Clientset, namespace string, listedPod *v1.Pod) {
-
-	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
+// newNodeInformerFactory builds the (unfiltered, cluster-wide) SharedInformerFactory used for
+// the node watch that backs the out-of-service taint logic.
+func newNodeInformerFactory(cli CLI, clientset *kubernetes.Clientset) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactory(clientset, cli.Interval)
+}
 
-	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), listedPod.Name, metav1.GetOptions{})
+func sleep(duration time.Duration, done chan struct{}) bool {
 
-	if err != nil {
-		_ = level.Error(logger).Log("message", fmt.Sprintf("%s: Cannot get pod details: %s", formatPodName(listedPod), err.Error()))
-		return
+	// Sleep, whilst checking for signals
+	select {
+	case <-done:
+		// Finished
+		return false
+	case <-time.After(duration):
+		// Continue opeation
+		return true
 	}
+}
 
-	// Check the state of the pod
-	now := time.Now()
-	deletionTimestamp := pod.ObjectMeta.DeletionTimestamp
-
-	if deletionTimestamp == nil {
-		// Not been terminated
-		return
-	}
+// runReconciler builds the informer-backed controller and runs it until done is closed, flipping
+// metricsServer's readiness once the caches have synced. This is the work that leader election
+// (when enabled) only runs on the leader; metricsServer itself is started unconditionally by
+// controlLoop so that standby replicas still serve /healthz and /readyz.
+func runReconciler(cli CLI, clientset *kubernetes.Clientset, metricsServer *metrics.Server, done chan struct{}) {
 
-	podName := formatPodName(pod)
+	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
 
-	// If pod is owned by a node, then it's static and should not be deleted this way.
-	if isStaticPod(pod) {
-		_ = level.Warn(logger).Log("message", fmt.Sprintf("%s: Cannot terminate static pod", podName))
-		return
-	}
+	podFactory := newPodInformerFactory(cli, clientset)
+	nodeFactory := newNodeInformerFactory(cli, clientset)
+	ctrl := controller.New(controllerConfig(cli), clientset, podFactory, nodeFactory, logger)
+	ctrl.OnSynced = func() { metricsServer.SetReady(true) }
 
-	// Total grace period allowed for termination. Pod's grace period + any set by command line
-	syntheticGracePeriod := (time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second) + cli.GracePeriod
+	podFactory.Start(done)
+	nodeFactory.Start(done)
 
-	// Current time minus the grace period
-	deleteBy := metav1.Time{Time: now.Add(-syntheticGracePeriod)}
+	_ = level.Info(logger).Log("message", "Watching for terminating pods")
 
-	if !deletionTimestamp.Before(&deleteBy) {
-		return
+	if err := ctrl.Run(context.Background(), cli.Workers, done); err != nil {
+		_ = level.Error(logger).Log("message", fmt.Sprintf("Controller exited with error: %s", err.Error()))
 	}
+}
 
-	// Copy finalizers
-	terminatingDuration := now.Sub(deletionTimestamp.Time).Round(time.Second)
-	_ = level.Warn(logger).Log("message", fmt.Sprintf("%s has been terminating for %v, which exceeds grace period of %v. Force deleting...", podName, terminatingDuration, syntheticGracePeriod))
+// leaderElectionIdentity returns the identity to record in the Lease: POD_NAME from the
+// downward API when running in a Deployment, falling back to a random UUID otherwise.
+func leaderElectionIdentity() string {
 
-	if cli.DryRun {
-		_ = level.Warn(logger).Log("message", fmt.Sprintf("%s with finalizers %v would be force deleted", podName, pod.Finalizers))
-		return
-	}
-
-	if !removeFinalizers(cli, clientset, pod) {
-		return
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName
 	}
 
-	deletePod(cli, clientset, pod)
+	return uuid.New().String()
 }
 
-// Iterate through all namespaces, checking pod states.
-// Returns false if we should shut down.
-func processNamespaces(cli CLI, clientset *kubernetes.Clientset, done chan bool) bool {
+// runWithLeaderElection only invokes runReconciler while this process holds the Lease named
+// cli.LeaderElectionID in cli.LeaderElectionNamespace, and closes done if leadership is lost.
+// metricsServer keeps serving /healthz regardless of leadership; its /readyz only reports ready
+// while this replica actually holds the lease and has synced.
+func runWithLeaderElection(cli CLI, clientset *kubernetes.Clientset, metricsServer *metrics.Server, done chan struct{}) {
 
 	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
-	namespaces, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
-
-	if err != nil {
-		_ = level.Error(logger).Log("message", fmt.Sprintf("ERROR: Cannot list namespaces: '%s'", err.Error()))
-		return true
+	identity := leaderElectionIdentity()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      cli.LeaderElectionID,
+			Namespace: cli.LeaderElectionNamespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
 	}
 
-	for _, ns := range namespaces.Items {
-
-		if len(cli.Namespaces) > 0 && !slices.Contains(cli.Namespaces, ns.Name) {
-			// Skip ns if user supplied a list of ns and this one not in that list.
-			continue
-		}
-
-		namespace := ns.Name
-		pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
-
-		if err != nil {
-			_ = level.Error(logger).Log("message", fmt.Sprintf("ERROR: Cannot list pods in namespace '%s': %s", namespace, err))
-			continue
-		}
-
-		for _, pod := range pods.Items {
-
-			if signalRaised(done) {
-				return false
-			}
-
-			if len(cli.Pods) > 0 {
-				// User specified pod prefixes?
-				process := false
-				for _, prefix := range cli.Pods {
-					if strings.HasPrefix(pod.Name, prefix) {
-						process = true
-						break
-					}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	// elector.Run invokes OnStartedLeading in its own goroutine and returns as soon as the lease
+	// is released, without waiting for that goroutine. We track it ourselves with a WaitGroup so
+	// that runWithLeaderElection doesn't return - and let controlLoop tear down the process -
+	// while runReconciler is still mid-drain.
+	var wg sync.WaitGroup
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				_ = level.Info(logger).Log("message", fmt.Sprintf("%s: started leading", identity))
+				wg.Add(1)
+				defer wg.Done()
+				runReconciler(cli, clientset, metricsServer, done)
+			},
+			OnStoppedLeading: func() {
+				_ = level.Warn(logger).Log("message", fmt.Sprintf("%s: stopped leading, shutting down", identity))
+				metricsServer.SetReady(false)
+				select {
+				case <-done:
+					// Already closed by the signal handler.
+				default:
+					close(done)
 				}
+			},
+		},
+	})
 
-				if !process {
-					continue
-				}
-			}
-
-			processPod(cli, clientset, namespace, &pod)
-		}
+	if err != nil {
+		_ = level.Error(logger).Log("message", fmt.Sprintf("Cannot create leader elector: %s", err.Error()))
+		return
 	}
 
-	return true
+	elector.Run(ctx)
+	wg.Wait()
 }
 
-func sleep(duration time.Duration, done chan bool) bool {
-
-	// Sleep, whilst checking for signals
-	select {
-	case <-done:
-		// Finished
-		return false
-	case <-time.After(duration):
-		// Continue opeation
-		return true
-	}
-}
-
-// Main control loop. Iterate all pods in all namespaces and check their state.
+// Main control loop. Starts the metrics/health server (unconditionally, so that standby replicas
+// under leader election still answer /healthz and /readyz), waits out the startup delay, then
+// runs the reconciler, optionally behind leader election, until a shutdown signal arrives.
 func controlLoop(cli CLI, clientset *kubernetes.Clientset) {
 
 	logger := getLogger(cli.LogLevel, cli.LogOutput, cli.LogFormat)
@@ -276,8 +272,8 @@ func controlLoop(cli CLI, clientset *kubernetes.Clientset) {
 	// Channel to receive OS signals
 	sigs := make(chan os.Signal, 1)
 
-	// Channel to indicate signal raised
-	done := make(chan bool, 1)
+	// Channel closed when a signal is raised
+	done := make(chan struct{})
 
 	// Set signals to listen for
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -285,6 +281,25 @@ func controlLoop(cli CLI, clientset *kubernetes.Clientset) {
 	// Start signal listener
 	go signalHandler(cli, sigs, done)
 
+	metricsServer := metrics.NewServer(cli.MetricsAddr)
+	metricsErrCh := metricsServer.Start()
+	_ = level.Info(logger).Log("message", fmt.Sprintf("Serving metrics and health endpoints on %s", cli.MetricsAddr))
+
+	go func() {
+		if err := <-metricsErrCh; err != nil {
+			_ = level.Error(logger).Log("message", fmt.Sprintf("Metrics server exited with error: %s", err.Error()))
+		}
+	}()
+
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			_ = level.Error(logger).Log("message", fmt.Sprintf("Error shutting down metrics server: %s", err.Error()))
+		}
+	}()
+
 	if cli.StartupDelay > 0 {
 		// For situiations where a cluster may have just come back online after a complete shutdown, allow
 		// it time to get its house in order prior to force terminating anything.
@@ -295,18 +310,12 @@ func controlLoop(cli CLI, clientset *kubernetes.Clientset) {
 		}
 	}
 
-	// Main loop
-	for {
-		_ = level.Info(logger).Log("message", "Checking for terminating pods")
-		if !processNamespaces(cli, clientset, done) {
-			return
-		}
-
-		// Sleep, whilst checking for signals
-		if !sleep(cli.Interval, done) {
-			return
-		}
+	if cli.EnableLeaderElection {
+		runWithLeaderElection(cli, clientset, metricsServer, done)
+		return
 	}
+
+	runReconciler(cli, clientset, metricsServer, done)
 }
 
 func main() {
@@ -315,12 +324,21 @@ func main() {
 
 	kong.Parse(&cli,
 		kong.Vars{
-			"default_interval": "5m",
-			"default_grace":    "1h",
-			"default_level":    "info",
-			"default_format":   "logfmt",
-			"default_output":   "stdout",
-			"default_startup":  "15m",
+			"default_interval":                  "5m",
+			"default_grace":                     "1h",
+			"default_level":                     "info",
+			"default_format":                    "logfmt",
+			"default_output":                    "stdout",
+			"default_startup":                   "15m",
+			"default_workers":                   "4",
+			"default_metrics_addr":              ":8080",
+			"default_oos_taint_key":             outOfServiceTaintKeyDefault,
+			"default_oos_timeout":               "5m",
+			"default_leader_election_namespace": "default",
+			"default_leader_election_id":        "terminator",
+			"default_mode":                      controller.ModeForceDelete,
+			"default_eviction_backoff":          "10s",
+			"default_eviction_max_retries":      "5",
 		})
 
 	var err error
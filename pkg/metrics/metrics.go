@@ -0,0 +1,84 @@
+// Copyright 2023 Firefly IT Consulting Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics registers terminator's Prometheus metrics and exposes small helpers for
+// incrementing them from the controller, so that callers don't need to reference the
+// underlying collectors directly.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	podsScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "terminator_pods_scanned_total",
+		Help: "Total number of pods examined for stuck termination.",
+	})
+
+	podsForceDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "terminator_pods_force_deleted_total",
+		Help: "Total number of pods force deleted, by namespace and result.",
+	}, []string{"namespace", "result"})
+
+	finalizersRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "terminator_finalizers_removed_total",
+		Help: "Total number of pods that had finalizers removed before force deletion.",
+	})
+
+	scanDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "terminator_scan_duration_seconds",
+		Help: "Time taken to reconcile a single pod.",
+	})
+
+	terminatingPods = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "terminator_terminating_pods",
+		Help: "Current number of pods known to be Terminating.",
+	})
+
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "terminator_api_errors_total",
+		Help: "Total number of Kubernetes API errors encountered, by verb.",
+	}, []string{"verb"})
+)
+
+// PodScanned records that a pod was examined for stuck termination.
+func PodScanned() {
+	podsScanned.Inc()
+}
+
+// PodForceDeleted records the result ("success", "error" or, in evict mode, "evicted") of removing a pod in namespace.
+func PodForceDeleted(namespace, result string) {
+	podsForceDeleted.WithLabelValues(namespace, result).Inc()
+}
+
+// FinalizerRemoved records that a pod's finalizers were stripped before force deletion.
+func FinalizerRemoved() {
+	finalizersRemoved.Inc()
+}
+
+// ScanDuration records how long a single pod reconcile took, in seconds.
+func ScanDuration(seconds float64) {
+	scanDuration.Observe(seconds)
+}
+
+// SetTerminatingPods sets the current count of pods known to be Terminating.
+func SetTerminatingPods(n int) {
+	terminatingPods.Set(float64(n))
+}
+
+// APIError records a Kubernetes API error for verb ("get", "list", "update", "delete", "patch", "evict").
+func APIError(verb string) {
+	apiErrors.WithLabelValues(verb).Inc()
+}
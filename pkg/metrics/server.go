@@ -0,0 +1,80 @@
+// Copyright 2023 Firefly IT Consulting Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server serves /metrics, /healthz and /readyz for a running terminator instance.
+type Server struct {
+	httpServer *http.Server
+	ready      atomic.Bool
+}
+
+// NewServer builds a Server listening on addr (e.g. ":8080"). Readiness starts false;
+// call SetReady(true) once the controller's caches have synced for the first time.
+func NewServer(addr string) *Server {
+
+	s := &Server{}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	return s
+}
+
+// SetReady flips the /readyz result.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Start begins serving in a background goroutine. It returns immediately; errors other than
+// http.ErrServerClosed are sent on the returned channel.
+func (s *Server) Start() <-chan error {
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+
+	return errCh
+}
+
+// Shutdown gracefully stops the server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}